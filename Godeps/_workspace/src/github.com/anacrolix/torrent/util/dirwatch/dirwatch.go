@@ -4,10 +4,25 @@ package dirwatch
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/anacrolix/missinggo"
 	"github.com/go-fsnotify/fsnotify"
@@ -23,59 +38,614 @@ const (
 	Removed
 )
 
+// HashV2 is the SHA-256 info-dict hash used to identify BitTorrent v2
+// (BEP 52) torrents. It's defined locally here rather than imported from
+// an infohash package, since this tree doesn't vendor one.
+type HashV2 [32]byte
+
 type Event struct {
 	MagnetURI string
 	Change
 	TorrentFilePath string
-	InfoHash        torrent.InfoHash
+	// InfoHash is the v1, or v1-compatible (hybrid), infohash, and is
+	// what Instance keys its state by.
+	InfoHash torrent.InfoHash
+	// InfoHashV2 is set for a v2 or hybrid torrent, identified by the
+	// "meta version" field of the info dict.
+	InfoHashV2 *HashV2
+	// Trackers is the announce URL plus any announce-list tiers, for
+	// .torrent files, or the tr= values, for magnets.
+	Trackers []string
+	// URLList is the BEP 19 url-list webseed URLs carried directly in a
+	// .torrent file.
+	URLList []string
+	// WebSeeds is the union of any magnet ws= parameters and the
+	// contents of a sibling .webseeds file.
+	WebSeeds []string
 }
 
 type entity struct {
 	torrent.InfoHash
+	InfoHashV2      *HashV2
 	MagnetURI       string
 	TorrentFilePath string
+	Trackers        []string
+	URLList         []string
+	WebSeeds        []string
+}
+
+// mergeEntities combines two entities known to describe the same
+// content, so a hybrid (v1/v2) torrent whose info dict is seen more than
+// once (e.g. a .torrent and a .magnet for the same InfoHash) is reported
+// once rather than twice.
+func mergeEntities(a, b entity) entity {
+	out := a
+	if out.TorrentFilePath == "" {
+		out.TorrentFilePath = b.TorrentFilePath
+	}
+	if len(b.MagnetURI) > len(out.MagnetURI) {
+		out.MagnetURI = b.MagnetURI
+	}
+	if out.InfoHash == (torrent.InfoHash{}) {
+		out.InfoHash = b.InfoHash
+	}
+	if out.InfoHashV2 == nil {
+		out.InfoHashV2 = b.InfoHashV2
+	}
+	out.Trackers = append(append([]string{}, out.Trackers...), b.Trackers...)
+	out.URLList = append(append([]string{}, out.URLList...), b.URLList...)
+	out.WebSeeds = append(append([]string{}, out.WebSeeds...), b.WebSeeds...)
+	return out
+}
+
+// addEntityTo adds e into ee, keyed by InfoHash, merging it with any
+// existing entity for the same InfoHash. Since InfoHashV2 is the SHA-256
+// of the info dict's own bytes, two entities can only share an
+// InfoHashV2 if they also share an InfoHash, so a direct InfoHash
+// collision is the only case that needs detecting: once either side
+// carries an InfoHashV2, they're merged with mergeEntities rather than
+// deduped with the "longest magnet URI wins" heuristic, which is only
+// appropriate for two magnet entries describing the same InfoHash.
+func addEntityTo(ee map[torrent.InfoHash]entity, e entity) {
+	if e0, ok := ee[e.InfoHash]; ok {
+		if e0.InfoHashV2 != nil || e.InfoHashV2 != nil {
+			ee[e.InfoHash] = mergeEntities(e0, e)
+			return
+		}
+		if e0.MagnetURI == "" || len(e.MagnetURI) < len(e0.MagnetURI) {
+			return
+		}
+	}
+	ee[e.InfoHash] = e
+}
+
+// Handler receives dirwatch's notifications. It replaces the old
+// unbuffered Events channel, which silently blocked handleEvents if the
+// consumer was slow and dropped the rest of the stream on Close.
+//
+// If a call returns an error, dirwatch retries it with exponential
+// backoff rather than dropping it, so a Handler should only return an
+// error for conditions it expects to clear up on their own. Each call
+// runs off the event loop goroutine, so a stuck retry doesn't block
+// event processing for other files; calls for the same infohash are
+// still delivered in order.
+type Handler interface {
+	OnAdded(Event) error
+	OnRemoved(Event) error
+}
+
+// SymlinkPolicy controls how dirwatch treats symlinked directories when
+// walking a tree recursively.
+type SymlinkPolicy int
+
+const (
+	// SymlinksIgnore leaves symlinked directories unwatched.
+	SymlinksIgnore SymlinkPolicy = iota
+	// SymlinksFollow descends into symlinked directories as if they were
+	// regular ones.
+	SymlinksFollow
+)
+
+// defaultRescanDebounce is how long we wait after the last filesystem event
+// in a burst before running a full rescan.
+const defaultRescanDebounce = 500 * time.Millisecond
+
+// writeDebounce is how long we wait after the last Write event on a given
+// file before re-parsing it, so an editor's write-then-rename (or a burst
+// of individual write(2) calls) only triggers one re-parse.
+const writeDebounce = 200 * time.Millisecond
+
+// handlerRetryInitialBackoff and handlerRetryMaxBackoff bound the
+// exponential backoff used to retry a Handler call that returned an
+// error.
+const (
+	handlerRetryInitialBackoff = 100 * time.Millisecond
+	handlerRetryMaxBackoff     = time.Minute
+)
+
+// defaultFetchTimeout and defaultMaxTorrentSize bound fetching a .torrent
+// referenced by an http(s) URL in a .magnet or .torrents file, used when
+// Options.FetchTimeout or Options.MaxTorrentSize aren't set.
+const (
+	defaultFetchTimeout   = 30 * time.Second
+	defaultMaxTorrentSize = 10 << 20 // 10MiB
+)
+
+// fetchFailureCooldown is how long a fetchTorrentURL failure for a
+// given URL is negative-cached, so a dead or slow URL referenced from a
+// .magnet/.torrents file isn't retried on every scan.
+const fetchFailureCooldown = time.Minute
+
+// Options configures recursive watching of a directory tree.
+type Options struct {
+	// Recursive causes subdirectories of the watched root to be watched
+	// too, including ones created after New is called.
+	Recursive bool
+	// MaxDepth limits how many directory levels below the root are
+	// descended into when Recursive is set. Zero means unlimited.
+	MaxDepth int
+	// Include, if non-empty, restricts watching to directory and file
+	// names matching at least one of these filepath.Match patterns.
+	Include []string
+	// Exclude skips directories and files matching any of these
+	// filepath.Match patterns, even if they also match Include.
+	Exclude []string
+	// Symlinks controls whether symlinked directories are followed when
+	// walking the tree.
+	Symlinks SymlinkPolicy
+	// RescanDebounce is the quiet period after the last fsnotify event
+	// before a full rescan runs, to absorb bursts such as an archive of
+	// torrents being unpacked. Zero uses defaultRescanDebounce.
+	RescanDebounce time.Duration
+	// HTTPClient fetches .torrent files referenced by an http(s) URL in a
+	// .magnet or .torrents file. Nil uses http.DefaultClient.
+	HTTPClient *http.Client
+	// FetchTimeout bounds each such fetch. Zero uses defaultFetchTimeout.
+	FetchTimeout time.Duration
+	// MaxTorrentSize caps the size of a fetched .torrent, so a
+	// misbehaving or malicious server can't exhaust memory or disk. Zero
+	// uses defaultMaxTorrentSize.
+	MaxTorrentSize int64
+	// CacheDir is where fetched .torrent files are cached, keyed by the
+	// SHA-1 of their source URL, so they're not re-fetched on every scan.
+	// It must be set for http(s) URLs to be followed; an empty CacheDir
+	// leaves them unresolved.
+	CacheDir string
+}
+
+func (o Options) matches(name string) bool {
+	if len(o.Include) != 0 {
+		included := false
+		for _, pat := range o.Include {
+			if ok, _ := filepath.Match(pat, name); ok {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, pat := range o.Exclude {
+		if ok, _ := filepath.Match(pat, name); ok {
+			return false
+		}
+	}
+	return true
 }
 
 type Instance struct {
-	w        *fsnotify.Watcher
-	dirName  string
-	Events   chan Event
-	dirState map[torrent.InfoHash]entity
+	w       *fsnotify.Watcher
+	dirName string
+	opts    Options
+	handler Handler
+	// statePath, if non-empty, is where dirState is persisted so a
+	// restart doesn't re-report every torrent already present.
+	statePath string
+	dirState  map[torrent.InfoHash]entity
+	// fileState tracks which entities were last parsed out of each
+	// source file, so a Write on one file can be diffed without
+	// rescanning the whole tree.
+	fileState map[string]map[torrent.InfoHash]entity
+	// acked tracks which infohashes currently in dirState have had their
+	// OnAdded call actually succeed, as opposed to merely having been
+	// scanned. persistState only ever writes out acked entries, so a
+	// crash between a scan and its handler calls completing can't make
+	// bootstrap skip re-reporting a torrent whose Added was never
+	// delivered.
+	acked map[torrent.InfoHash]bool
+	// watched tracks every directory currently registered with w, keyed
+	// by its depth below dirName, so a removed subtree can be unwound.
+	watched map[string]int
+	// writeTimers coalesces bursts of Write events on the same file
+	// into a single re-parse.
+	writeTimers map[string]*time.Timer
+	writeReady  chan string
+	// handlerChain serializes callHandler calls for a given infohash, so
+	// an Added and a later Removed (or vice versa) for the same torrent
+	// aren't reordered by running concurrently; it's only ever touched
+	// from the handleEvents goroutine (and bootstrap, before handleEvents
+	// starts), so it needs no locking of its own.
+	handlerChain map[torrent.InfoHash]chan struct{}
+
+	// fetchMu guards fetching and fetchFailure, which unlike the rest of
+	// Instance's state are also touched by the background goroutines
+	// resolveTorrentURL starts to fetch http(s) .torrent URLs, so they
+	// need real synchronization rather than being confined to the
+	// handleEvents goroutine.
+	fetchMu      sync.Mutex
+	fetching     map[string]bool
+	fetchFailure map[string]time.Time
+
+	// ackReq carries an infohash back to handleEvents from the
+	// enqueueHandlerCall goroutine that ran its OnAdded, once that call
+	// has actually succeeded, so handleEvents can mark it acked and
+	// persist it.
+	ackReq      chan torrent.InfoHash
+	rescanReq   chan struct{}
+	snapshotReq chan snapshotRequest
+	closed      chan struct{}
+}
+
+type snapshotRequest struct {
+	resp chan map[torrent.InfoHash]Event
 }
 
 func (me *Instance) Close() {
+	close(me.closed)
 	me.w.Close()
 }
 
+// Snapshot returns the entities currently tracked, each as the Event
+// that would be delivered if it were added right now. It returns nil if
+// the Instance is closed before the snapshot could be taken.
+func (me *Instance) Snapshot() map[torrent.InfoHash]Event {
+	req := snapshotRequest{resp: make(chan map[torrent.InfoHash]Event, 1)}
+	select {
+	case me.snapshotReq <- req:
+	case <-me.closed:
+		return nil
+	}
+	select {
+	case snap := <-req.resp:
+		return snap
+	case <-me.closed:
+		return nil
+	}
+}
+
+// Rescan forces an immediate full sweep of the watched tree, bypassing
+// the rescan debounce timer.
+func (me *Instance) Rescan() {
+	select {
+	case me.rescanReq <- struct{}{}:
+	case <-me.closed:
+	}
+}
+
+// addWatch registers dir (depth levels below the root) with the
+// underlying fsnotify.Watcher, and recurses into its children if
+// me.opts.Recursive permits it.
+func (me *Instance) addWatch(dir string, depth int) {
+	me.addWatchVisited(dir, depth, make(map[string]bool))
+}
+
+// addWatchVisited is addWatch's recursive worker. visited tracks the
+// resolved real path of every directory entered so far in this walk, so
+// a symlink cycle (when Options.Symlinks is SymlinksFollow) can't send
+// it into unbounded recursion.
+func (me *Instance) addWatchVisited(dir string, depth int, visited map[string]bool) {
+	if _, ok := me.watched[dir]; ok {
+		return
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if me.opts.Symlinks != SymlinksFollow {
+			return
+		}
+		fi, err = os.Stat(dir)
+		if err != nil {
+			return
+		}
+	}
+	if !fi.IsDir() {
+		return
+	}
+	if dir != me.dirName && !me.opts.matches(filepath.Base(dir)) {
+		return
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return
+	}
+	if visited[real] {
+		return
+	}
+	visited[real] = true
+	if err := me.w.Add(dir); err != nil {
+		log.Printf("error adding watch for %q: %s", dir, err)
+		return
+	}
+	me.watched[dir] = depth
+	if !me.opts.Recursive {
+		return
+	}
+	if me.opts.MaxDepth > 0 && depth >= me.opts.MaxDepth {
+		return
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return
+	}
+	for _, n := range names {
+		me.addWatchVisited(filepath.Join(dir, n), depth+1, visited)
+	}
+}
+
+// removeWatch detaches the watch on dir and every subdirectory under it
+// that we're currently tracking.
+func (me *Instance) removeWatch(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for p := range me.watched {
+		if p == dir || strings.HasPrefix(p, prefix) {
+			me.w.Remove(p)
+			delete(me.watched, p)
+		}
+	}
+}
+
 func (me *Instance) handleEvents() {
-	defer close(me.Events)
-	for e := range me.w.Events {
-		log.Printf("event: %s", e)
-		if e.Op == fsnotify.Write {
-			// TODO: Special treatment as an existing torrent may have changed.
+	debounce := me.opts.RescanDebounce
+	if debounce <= 0 {
+		debounce = defaultRescanDebounce
+	}
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	scheduleRescan := func() {
+		if timer == nil {
+			timer = time.NewTimer(debounce)
 		} else {
+			// timerC is nil once the rescan case has received the fired
+			// value, so only drain timer.C if that hasn't happened yet.
+			if !timer.Stop() && timerC != nil {
+				<-timer.C
+			}
+			timer.Reset(debounce)
+		}
+		timerC = timer.C
+	}
+	for {
+		select {
+		case e, ok := <-me.w.Events:
+			if !ok {
+				return
+			}
+			log.Printf("event: %s", e)
+			switch {
+			case e.Op&fsnotify.Remove != 0 || e.Op&fsnotify.Rename != 0:
+				me.removeWatch(e.Name)
+				scheduleRescan()
+			case e.Op&fsnotify.Create != 0:
+				me.addWatch(e.Name, me.depthOf(filepath.Dir(e.Name))+1)
+				scheduleRescan()
+			case e.Op&fsnotify.Write != 0:
+				me.scheduleWrite(e.Name)
+			default:
+				scheduleRescan()
+			}
+		case <-timerC:
+			timerC = nil
+			me.refresh()
+		case name := <-me.writeReady:
+			delete(me.writeTimers, name)
+			me.handleWrite(name)
+		case <-me.rescanReq:
 			me.refresh()
+		case req := <-me.snapshotReq:
+			req.resp <- me.snapshot()
+		case ih := <-me.ackReq:
+			me.acked[ih] = true
+			me.persistState()
+		case <-me.closed:
+			if timer != nil {
+				timer.Stop()
+			}
+			for _, t := range me.writeTimers {
+				t.Stop()
+			}
+			return
 		}
 	}
 }
 
+// scheduleWrite debounces repeated Write events on the same file, so that
+// an editor's write-then-rename, or several back-to-back write(2) calls,
+// results in a single re-parse.
+func (me *Instance) scheduleWrite(name string) {
+	if t, ok := me.writeTimers[name]; ok {
+		t.Stop()
+	}
+	me.writeTimers[name] = time.AfterFunc(writeDebounce, func() {
+		select {
+		case me.writeReady <- name:
+		case <-me.closed:
+		}
+	})
+}
+
+// handleWrite re-parses a single file that fsnotify reported as written,
+// and emits precise Added/Removed events for the difference from what it
+// last contributed to dirState. A file that now parses to nothing (for
+// example because it was truncated to zero bytes) is treated as if every
+// entity it previously sourced was removed. An infohash contributed by
+// more than one file (e.g. a .torrent and a .magnet both describing the
+// same torrent) is recomputed from every file still contributing it via
+// mergedEntityFor, rather than simply overwritten with fullName's
+// contribution, so editing one of them doesn't drop the other's data.
+func (me *Instance) handleWrite(fullName string) {
+	if !me.opts.matches(filepath.Base(fullName)) {
+		return
+	}
+	switch {
+	case isTorrentFile(fullName):
+	case filepath.Ext(fullName) == ".magnet" || filepath.Ext(fullName) == ".torrents":
+	default:
+		return
+	}
+	newEntities := me.scanFile(fullName)
+	affected := make(map[torrent.InfoHash]bool)
+	for ih := range me.fileState[fullName] {
+		affected[ih] = true
+	}
+	for ih := range newEntities {
+		affected[ih] = true
+	}
+	if len(newEntities) == 0 {
+		delete(me.fileState, fullName)
+	} else {
+		me.fileState[fullName] = newEntities
+	}
+	for ih := range affected {
+		merged, ok := me.mergedEntityFor(ih)
+		old, hadOld := me.dirState[ih]
+		if !ok {
+			if hadOld {
+				delete(me.dirState, ih)
+				me.torrentRemoved(ih)
+			}
+			continue
+		}
+		if hadOld {
+			if entitiesEqual(old, merged) {
+				continue
+			}
+			me.torrentRemoved(ih)
+		}
+		me.dirState[ih] = merged
+		me.torrentAdded(merged)
+	}
+	me.persistState()
+}
+
+// mergedEntityFor recomputes the entity for ih by folding together every
+// fileState entry that currently contributes it, the same way
+// scanDirInto aggregates entities across a whole directory via
+// addEntityTo, so a Write on one of several files sharing an InfoHash
+// doesn't drop the others' contribution.
+func (me *Instance) mergedEntityFor(ih torrent.InfoHash) (entity, bool) {
+	files := make([]string, 0, len(me.fileState))
+	for f := range me.fileState {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	ee := make(map[torrent.InfoHash]entity)
+	for _, f := range files {
+		if e, ok := me.fileState[f][ih]; ok {
+			addEntityTo(ee, e)
+		}
+	}
+	e, ok := ee[ih]
+	return e, ok
+}
+
+func (me *Instance) depthOf(dir string) int {
+	if d, ok := me.watched[dir]; ok {
+		return d
+	}
+	return 0
+}
+
 func (me *Instance) handleErrors() {
 	for err := range me.w.Errors {
 		log.Printf("error in torrent directory watcher: %s", err)
 	}
 }
 
-func torrentFileInfoHash(fileName string) (ih torrent.InfoHash, ok bool) {
+// loadTorrentFile parses fileName fully, returning its v1 (or
+// v1-compatible, for a hybrid torrent) infohash, its v2 infohash if the
+// info dict declares a BEP 52 "meta version", and the trackers and BEP
+// 19 url-list webseeds it declares.
+func loadTorrentFile(fileName string) (ih torrent.InfoHash, v2 *HashV2, trackers, urlList []string, ok bool) {
 	mi, _ := metainfo.LoadFromFile(fileName)
 	if mi == nil {
 		return
 	}
+	if mi.Info.MetaVersion >= 2 {
+		sum := sha256.Sum256(mi.InfoBytes)
+		h := HashV2(sum)
+		v2 = &h
+	}
 	missinggo.CopyExact(ih[:], mi.Info.Hash)
+	if mi.Announce != "" {
+		trackers = append(trackers, mi.Announce)
+	}
+	for _, tier := range mi.AnnounceList {
+		trackers = append(trackers, tier...)
+	}
+	urlList = mi.UrlList
 	ok = true
 	return
 }
 
-func scanDir(dirName string) (ee map[torrent.InfoHash]entity) {
+// isTorrentFile reports whether name is a .torrent file.
+func isTorrentFile(name string) bool {
+	return filepath.Ext(name) == ".torrent"
+}
+
+// magnetWebSeeds extracts the ws= query parameters from a magnet URI.
+func magnetWebSeeds(uri string) []string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil
+	}
+	return u.Query()["ws"]
+}
+
+// webSeedsFilePath is the sibling .webseeds file for a .torrent,
+// .magnet or .torrents file, e.g. "foo.torrent" -> "foo.webseeds".
+func webSeedsFilePath(fullName string) string {
+	return strings.TrimSuffix(fullName, filepath.Ext(fullName)) + ".webseeds"
+}
+
+// readWebSeeds returns the webseeds declared in the sibling .webseeds
+// file for fullName, if any.
+func readWebSeeds(fullName string) []string {
+	ws, err := readURIList(webSeedsFilePath(fullName))
+	if err != nil {
+		return nil
+	}
+	return ws
+}
+
+// scanDir walks dirName (recursively, if the Instance was configured for
+// it) collecting every entity it finds into ee, keyed by InfoHash, along
+// with the per-file breakdown that produced it.
+func (me *Instance) scanDir(dirName string, depth int) (ee map[torrent.InfoHash]entity, fileState map[string]map[torrent.InfoHash]entity) {
+	ee = make(map[torrent.InfoHash]entity)
+	fileState = make(map[string]map[torrent.InfoHash]entity)
+	me.scanDirInto(dirName, depth, ee, fileState, make(map[string]bool))
+	return
+}
+
+// scanDirInto is scanDir's recursive worker. visited tracks the resolved
+// real path of every directory entered so far in this walk, so a
+// symlink cycle (when Options.Symlinks is SymlinksFollow) can't send it
+// into unbounded recursion.
+func (me *Instance) scanDirInto(dirName string, depth int, ee map[torrent.InfoHash]entity, fileState map[string]map[torrent.InfoHash]entity, visited map[string]bool) {
+	if real, err := filepath.EvalSymlinks(dirName); err == nil {
+		if visited[real] {
+			return
+		}
+		visited[real] = true
+	}
 	d, err := os.Open(dirName)
 	if err != nil {
 		log.Print(err)
@@ -87,7 +657,205 @@ func scanDir(dirName string) (ee map[torrent.InfoHash]entity) {
 		log.Print(err)
 		return
 	}
-	ee = make(map[torrent.InfoHash]entity, len(names))
+	for _, n := range names {
+		if !me.opts.matches(n) {
+			continue
+		}
+		fullName := filepath.Join(dirName, n)
+		switch {
+		case isTorrentFile(n) || filepath.Ext(n) == ".magnet" || filepath.Ext(n) == ".torrents":
+			fe := me.scanFile(fullName)
+			if len(fe) == 0 {
+				continue
+			}
+			fileState[fullName] = fe
+			for _, e := range fe {
+				addEntityTo(ee, e)
+			}
+		default:
+			if !me.opts.Recursive {
+				continue
+			}
+			if me.opts.MaxDepth > 0 && depth >= me.opts.MaxDepth {
+				continue
+			}
+			fi, err := os.Lstat(fullName)
+			if err != nil || !fi.IsDir() {
+				if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+					continue
+				}
+				if me.opts.Symlinks != SymlinksFollow {
+					continue
+				}
+				if sfi, err := os.Stat(fullName); err != nil || !sfi.IsDir() {
+					continue
+				}
+			}
+			me.scanDirInto(fullName, depth+1, ee, fileState, visited)
+		}
+	}
+}
+
+// loadTorrentEntity loads the .torrent file at path into an entity,
+// including its webseeds from any sibling .webseeds file.
+func loadTorrentEntity(path string) (entity, bool) {
+	ih, v2, trackers, urlList, ok := loadTorrentFile(path)
+	if !ok {
+		return entity{}, false
+	}
+	e := entity{
+		TorrentFilePath: path,
+		InfoHashV2:      v2,
+		Trackers:        trackers,
+		URLList:         urlList,
+		WebSeeds:        readWebSeeds(path),
+	}
+	missinggo.CopyExact(&e.InfoHash, ih)
+	return e, true
+}
+
+// fetchTorrentURL fetches the .torrent at u over HTTP(S), subject to
+// me.opts.HTTPClient, FetchTimeout and MaxTorrentSize, and caches it
+// under me.opts.CacheDir keyed by the SHA-1 of u so it's not re-fetched
+// on every scan. The response is parsed before being cached, so a
+// misbehaving server's non-torrent response is reported as a fetch
+// failure (and negative-cached by fetchTorrentURLAsync like any other)
+// rather than being written to CacheDir where it would fail to parse
+// forever. It returns the path to the cached copy.
+func (me *Instance) fetchTorrentURL(u string) (cachedPath string, err error) {
+	if me.opts.CacheDir == "" {
+		return "", fmt.Errorf("fetching %q: no CacheDir configured", u)
+	}
+	sum := sha1.Sum([]byte(u))
+	cachedPath = filepath.Join(me.opts.CacheDir, hex.EncodeToString(sum[:])+".torrent")
+	if _, err := os.Stat(cachedPath); err == nil {
+		return cachedPath, nil
+	}
+	client := me.opts.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	timeout := me.opts.FetchTimeout
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %q: unexpected status %q", u, resp.Status)
+	}
+	maxSize := me.opts.MaxTorrentSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxTorrentSize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(body)) > maxSize {
+		return "", fmt.Errorf("fetching %q: exceeds %d byte size cap", u, maxSize)
+	}
+	if _, err := metainfo.Load(bytes.NewReader(body)); err != nil {
+		return "", fmt.Errorf("fetching %q: not a valid torrent: %s", u, err)
+	}
+	if err := os.MkdirAll(me.opts.CacheDir, 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(cachedPath, body, 0644); err != nil {
+		return "", err
+	}
+	return cachedPath, nil
+}
+
+// resolveTorrentURL returns the cached path for an http(s) .torrent URL
+// referenced from a .magnet or .torrents file, without blocking the
+// scanning goroutine on the network. If a cached copy already exists it
+// returns it immediately; otherwise it kicks off a background fetch
+// (unless one for u is already in flight, or u failed recently enough
+// to still be within fetchFailureCooldown) and reports ok=false for
+// this scan, so scanDirInto and handleWrite can't be stalled by a slow
+// or unreachable URL. The entity shows up once a later scan, triggered
+// by the fetch's own Rescan call, finds the populated cache.
+func (me *Instance) resolveTorrentURL(u string) (cachedPath string, ok bool) {
+	if me.opts.CacheDir == "" {
+		return "", false
+	}
+	sum := sha1.Sum([]byte(u))
+	cachedPath = filepath.Join(me.opts.CacheDir, hex.EncodeToString(sum[:])+".torrent")
+	if _, err := os.Stat(cachedPath); err == nil {
+		return cachedPath, true
+	}
+	me.fetchMu.Lock()
+	defer me.fetchMu.Unlock()
+	if me.fetching[u] {
+		return "", false
+	}
+	if failedAt, ok := me.fetchFailure[u]; ok && time.Since(failedAt) < fetchFailureCooldown {
+		return "", false
+	}
+	me.fetching[u] = true
+	go me.fetchTorrentURLAsync(u)
+	return "", false
+}
+
+// fetchTorrentURLAsync runs fetchTorrentURL in the background, off the
+// handleEvents goroutine, and records the outcome so resolveTorrentURL
+// can avoid starting a redundant fetch or retrying a recent failure. On
+// success it triggers a Rescan so the newly cached torrent is picked up
+// without waiting for the next unrelated filesystem event.
+func (me *Instance) fetchTorrentURLAsync(u string) {
+	_, err := me.fetchTorrentURL(u)
+	me.fetchMu.Lock()
+	delete(me.fetching, u)
+	if err != nil {
+		log.Printf("error fetching %q: %s", u, err)
+		me.fetchFailure[u] = time.Now()
+	} else {
+		delete(me.fetchFailure, u)
+	}
+	me.fetchMu.Unlock()
+	if err == nil {
+		me.Rescan()
+	}
+}
+
+// scanFile parses a single .torrent, .magnet or .torrents file into the
+// entities it contributes, keyed by InfoHash.
+func (me *Instance) scanFile(fullName string) map[torrent.InfoHash]entity {
+	ee := make(map[torrent.InfoHash]entity)
+	switch {
+	case isTorrentFile(fullName):
+		if e, ok := loadTorrentEntity(fullName); ok {
+			ee[e.InfoHash] = e
+		}
+	case filepath.Ext(fullName) == ".magnet" || filepath.Ext(fullName) == ".torrents":
+		me.scanSourceFile(fullName, ee)
+	}
+	return ee
+}
+
+// scanSourceFile parses fullName as the newline/whitespace-delimited
+// list of entries shared by .magnet and .torrents files. Each entry is a
+// magnet URI, an http(s) URL to a .torrent (fetched and cached via
+// resolveTorrentURL), or a path to a .torrent file, relative to
+// fullName's directory if not absolute. Resolved entities are added to
+// ee; a URL that can't be resolved on this scan (not yet cached) is
+// silently skipped rather than blocking the scan on the network.
+func (me *Instance) scanSourceFile(fullName string, ee map[torrent.InfoHash]entity) {
+	uris, err := sourceFileURIs(fullName)
+	if err != nil {
+		log.Print(err)
+		return
+	}
 	addEntity := func(e entity) {
 		e0, ok := ee[e.InfoHash]
 		if ok {
@@ -97,42 +865,53 @@ func scanDir(dirName string) (ee map[torrent.InfoHash]entity) {
 		}
 		ee[e.InfoHash] = e
 	}
-	for _, n := range names {
-		fullName := filepath.Join(dirName, n)
-		switch filepath.Ext(n) {
-		case ".torrent":
-			ih, ok := torrentFileInfoHash(fullName)
+	sibling := readWebSeeds(fullName)
+	for _, uri := range uris {
+		switch {
+		case strings.HasPrefix(uri, "magnet:"):
+			m, err := torrent.ParseMagnetURI(uri)
+			if err != nil {
+				log.Printf("error parsing %q in file %q: %s", uri, fullName, err)
+				continue
+			}
+			addEntity(entity{
+				InfoHash:  m.InfoHash,
+				MagnetURI: uri,
+				Trackers:  m.Trackers,
+				WebSeeds:  append(magnetWebSeeds(uri), sibling...),
+			})
+		case strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://"):
+			cached, ok := me.resolveTorrentURL(uri)
 			if !ok {
-				break
+				continue
 			}
-			e := entity{
-				TorrentFilePath: fullName,
+			e, ok := loadTorrentEntity(cached)
+			if !ok {
+				log.Printf("error parsing torrent fetched from %q", uri)
+				continue
 			}
-			missinggo.CopyExact(&e.InfoHash, ih)
 			addEntity(e)
-		case ".magnet":
-			uris, err := magnetFileURIs(fullName)
-			if err != nil {
-				log.Print(err)
-				break
+		default:
+			resolved := uri
+			if !filepath.IsAbs(resolved) {
+				resolved = filepath.Join(filepath.Dir(fullName), resolved)
 			}
-			for _, uri := range uris {
-				m, err := torrent.ParseMagnetURI(uri)
-				if err != nil {
-					log.Printf("error parsing %q in file %q: %s", uri, fullName, err)
-					continue
-				}
-				addEntity(entity{
-					InfoHash:  m.InfoHash,
-					MagnetURI: uri,
-				})
+			e, ok := loadTorrentEntity(resolved)
+			if !ok {
+				log.Printf("error loading %q referenced from %q", resolved, fullName)
+				continue
 			}
+			addEntity(e)
 		}
 	}
-	return
 }
 
-func magnetFileURIs(name string) (uris []string, err error) {
+// readURIList reads whitespace-separated URIs from name, one conceptual
+// entry per token, skipping any token that begins with '#'. Only that
+// token is skipped: further words on a line starting with "# " are still
+// returned as entries. Used for .magnet and .torrents files, and sibling
+// .webseeds files.
+func readURIList(name string) (uris []string, err error) {
 	f, err := os.Open(name)
 	if err != nil {
 		return
@@ -141,7 +920,6 @@ func magnetFileURIs(name string) (uris []string, err error) {
 	scanner := bufio.NewScanner(f)
 	scanner.Split(bufio.ScanWords)
 	for scanner.Scan() {
-		// Allow magnet URIs to be "commented" out.
 		if strings.HasPrefix(scanner.Text(), "#") {
 			continue
 		}
@@ -151,26 +929,121 @@ func magnetFileURIs(name string) (uris []string, err error) {
 	return
 }
 
+// sourceFileURIs returns the magnet URIs, torrent URLs and torrent paths
+// listed in a .magnet or .torrents file.
+func sourceFileURIs(name string) (uris []string, err error) {
+	return readURIList(name)
+}
+
+// entitiesEqual reports whether a and b describe the same entity. entity
+// now carries slice fields (Trackers, URLList, WebSeeds), so it can no
+// longer be compared with ==.
+func entitiesEqual(a, b entity) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// callHandler invokes try, retrying with exponential backoff as long as
+// it keeps returning an error, until the Instance is closed. It reports
+// whether try ultimately succeeded, as opposed to callHandler giving up
+// because the Instance closed while a retry was pending.
+func (me *Instance) callHandler(try func() error) (succeeded bool) {
+	backoff := handlerRetryInitialBackoff
+	for {
+		err := try()
+		if err == nil {
+			return true
+		}
+		log.Printf("dirwatch: handler error, retrying in %s: %s", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-me.closed:
+			return false
+		}
+		backoff *= 2
+		if backoff > handlerRetryMaxBackoff {
+			backoff = handlerRetryMaxBackoff
+		}
+	}
+}
+
+// enqueueHandlerCall runs try (via callHandler, so it's retried on
+// error) in its own goroutine, so a slow or retrying call doesn't block
+// handleEvents from processing unrelated events. Calls queued for the
+// same infohash are chained so they still run in the order they were
+// enqueued, even though they're no longer run on the caller's
+// goroutine. If ack is true and try succeeds, ih is sent to handleEvents
+// on ackReq, so an Added is only persisted once its OnAdded call has
+// actually gone through.
+func (me *Instance) enqueueHandlerCall(ih torrent.InfoHash, try func() error, ack bool) {
+	prev := me.handlerChain[ih]
+	done := make(chan struct{})
+	me.handlerChain[ih] = done
+	go func() {
+		defer close(done)
+		if prev != nil {
+			select {
+			case <-prev:
+			case <-me.closed:
+				return
+			}
+		}
+		if me.callHandler(try) && ack {
+			select {
+			case me.ackReq <- ih:
+			case <-me.closed:
+			}
+		}
+	}()
+}
+
+// torrentRemoved unacks ih immediately, since dirState no longer carries
+// an entity for it, then enqueues the OnRemoved call itself.
 func (me *Instance) torrentRemoved(ih torrent.InfoHash) {
-	me.Events <- Event{
+	delete(me.acked, ih)
+	e := Event{
 		InfoHash: ih,
 		Change:   Removed,
 	}
+	me.enqueueHandlerCall(ih, func() error { return me.handler.OnRemoved(e) }, false)
 }
 
 func (me *Instance) torrentAdded(e entity) {
-	me.Events <- Event{
+	ev := Event{
 		InfoHash:        e.InfoHash,
+		InfoHashV2:      e.InfoHashV2,
 		Change:          Added,
 		MagnetURI:       e.MagnetURI,
 		TorrentFilePath: e.TorrentFilePath,
+		Trackers:        e.Trackers,
+		URLList:         e.URLList,
+		WebSeeds:        e.WebSeeds,
+	}
+	me.enqueueHandlerCall(e.InfoHash, func() error { return me.handler.OnAdded(ev) }, true)
+}
+
+// snapshot returns the entities currently tracked as the Added Event
+// that announced each of them.
+func (me *Instance) snapshot() map[torrent.InfoHash]Event {
+	snap := make(map[torrent.InfoHash]Event, len(me.dirState))
+	for ih, e := range me.dirState {
+		snap[ih] = Event{
+			InfoHash:        ih,
+			InfoHashV2:      e.InfoHashV2,
+			Change:          Added,
+			MagnetURI:       e.MagnetURI,
+			TorrentFilePath: e.TorrentFilePath,
+			Trackers:        e.Trackers,
+			URLList:         e.URLList,
+			WebSeeds:        e.WebSeeds,
+		}
 	}
+	return snap
 }
 
 func (me *Instance) refresh() {
-	_new := scanDir(me.dirName)
+	_new, newFileState := me.scanDir(me.dirName, 0)
 	old := me.dirState
-	for ih, _ := range old {
+	for ih := range old {
 		_, ok := _new[ih]
 		if !ok {
 			me.torrentRemoved(ih)
@@ -179,7 +1052,7 @@ func (me *Instance) refresh() {
 	for ih, newE := range _new {
 		oldE, ok := old[ih]
 		if ok {
-			if newE == oldE {
+			if entitiesEqual(newE, oldE) {
 				continue
 			}
 			me.torrentRemoved(ih)
@@ -187,26 +1060,177 @@ func (me *Instance) refresh() {
 		me.torrentAdded(newE)
 	}
 	me.dirState = _new
+	me.fileState = newFileState
+	me.persistState()
 }
 
-func New(dirName string) (i *Instance, err error) {
-	w, err := fsnotify.NewWatcher()
+// bootstrap performs the first scan of the tree. Unlike refresh, it
+// compares against state persisted by a previous run, so a torrent
+// that's unchanged since that run doesn't cause a spurious OnAdded. A
+// torrent recognised this way was already acked by the run that
+// persisted it, so it's marked acked here too rather than waiting on a
+// callHandler that's never going to run.
+func (me *Instance) bootstrap(persisted map[torrent.InfoHash]persistedEntity) {
+	_new, newFileState := me.scanDir(me.dirName, 0)
+	for ih, e := range _new {
+		sp := sourcePathOf(newFileState, ih, e)
+		if pe, ok := persisted[ih]; ok && sp != "" && pe.SourcePath == sp {
+			if fi, err := os.Stat(sp); err == nil && fi.ModTime().UnixNano() == pe.ModTime {
+				me.acked[ih] = true
+				continue
+			}
+		}
+		me.torrentAdded(e)
+	}
+	me.dirState = _new
+	me.fileState = newFileState
+	me.persistState()
+}
+
+// persistedEntity is the on-disk record of an entity dirwatch has seen,
+// used by bootstrap to recognise torrents a previous run already
+// reported.
+type persistedEntity struct {
+	SourcePath string `json:"source_path"`
+	ModTime    int64  `json:"mod_time"`
+	MagnetURI  string `json:"magnet_uri,omitempty"`
+}
+
+type stateFile struct {
+	Entities map[string]persistedEntity `json:"entities"`
+}
+
+// sourcePathOf returns the file that contributed e, looking it up in
+// fileState for magnet entities, which don't carry their source file
+// directly.
+func sourcePathOf(fileState map[string]map[torrent.InfoHash]entity, ih torrent.InfoHash, e entity) string {
+	if e.TorrentFilePath != "" {
+		return e.TorrentFilePath
+	}
+	files := make([]string, 0, len(fileState))
+	for f, ee := range fileState {
+		if _, ok := ee[ih]; ok {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return ""
+	}
+	sort.Strings(files)
+	return files[0]
+}
+
+// loadState reads a previously persisted snapshot. A missing or
+// unreadable file is treated as no prior state.
+func loadState(path string) map[torrent.InfoHash]persistedEntity {
+	out := make(map[torrent.InfoHash]persistedEntity)
+	if path == "" {
+		return out
+	}
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
+		return out
+	}
+	var sf stateFile
+	if err := json.Unmarshal(b, &sf); err != nil {
+		log.Printf("dirwatch: error parsing state file %q: %s", path, err)
+		return out
+	}
+	for k, pe := range sf.Entities {
+		raw, err := hex.DecodeString(k)
+		if err != nil || len(raw) != len(torrent.InfoHash{}) {
+			continue
+		}
+		var ih torrent.InfoHash
+		missinggo.CopyExact(ih[:], raw)
+		out[ih] = pe
+	}
+	return out
+}
+
+// persistState writes a snapshot of dirState to me.statePath, atomically
+// replacing any previous one. It's a no-op if no statePath was given.
+// Only entities in me.acked are written, so a torrent whose OnAdded
+// hasn't actually succeeded yet isn't recorded as seen: were it
+// recorded eagerly, a crash between the scan and the handler call
+// completing would make bootstrap skip re-reporting it on restart, even
+// though it was never delivered.
+func (me *Instance) persistState() {
+	if me.statePath == "" {
 		return
 	}
-	err = w.Add(dirName)
+	sf := stateFile{Entities: make(map[string]persistedEntity, len(me.acked))}
+	for ih := range me.acked {
+		e, ok := me.dirState[ih]
+		if !ok {
+			continue
+		}
+		sp := sourcePathOf(me.fileState, ih, e)
+		var mtime int64
+		if sp != "" {
+			if fi, err := os.Stat(sp); err == nil {
+				mtime = fi.ModTime().UnixNano()
+			}
+		}
+		sf.Entities[hex.EncodeToString(ih[:])] = persistedEntity{
+			SourcePath: sp,
+			ModTime:    mtime,
+			MagnetURI:  e.MagnetURI,
+		}
+	}
+	b, err := json.Marshal(sf)
+	if err != nil {
+		log.Printf("dirwatch: error marshalling state: %s", err)
+		return
+	}
+	tmp := me.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		log.Printf("dirwatch: error writing state file %q: %s", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, me.statePath); err != nil {
+		log.Printf("dirwatch: error replacing state file %q: %s", me.statePath, err)
+	}
+}
+
+// New begins watching dirName according to o, delivering notifications
+// to h. If statePath is non-empty, a snapshot of the entities seen is
+// persisted there, and consulted on startup so a torrent a previous run
+// already reported doesn't trigger another OnAdded.
+func New(dirName string, o Options, h Handler, statePath string) (i *Instance, err error) {
+	w, err := fsnotify.NewWatcher()
 	if err != nil {
-		w.Close()
 		return
 	}
 	i = &Instance{
-		w:        w,
-		dirName:  dirName,
-		Events:   make(chan Event),
-		dirState: make(map[torrent.InfoHash]entity, 0),
+		w:            w,
+		dirName:      dirName,
+		opts:         o,
+		handler:      h,
+		statePath:    statePath,
+		dirState:     make(map[torrent.InfoHash]entity, 0),
+		fileState:    make(map[string]map[torrent.InfoHash]entity),
+		acked:        make(map[torrent.InfoHash]bool),
+		watched:      make(map[string]int),
+		writeTimers:  make(map[string]*time.Timer),
+		writeReady:   make(chan string),
+		handlerChain: make(map[torrent.InfoHash]chan struct{}),
+		fetching:     make(map[string]bool),
+		fetchFailure: make(map[string]time.Time),
+		ackReq:       make(chan torrent.InfoHash),
+		rescanReq:    make(chan struct{}),
+		snapshotReq:  make(chan snapshotRequest),
+		closed:       make(chan struct{}),
+	}
+	i.addWatch(dirName, 0)
+	if _, ok := i.watched[dirName]; !ok {
+		w.Close()
+		err = &os.PathError{Op: "watch", Path: dirName, Err: os.ErrInvalid}
+		return
 	}
+	persisted := loadState(statePath)
 	go func() {
-		i.refresh()
+		i.bootstrap(persisted)
 		go i.handleEvents()
 		go i.handleErrors()
 	}()
@@ -0,0 +1,300 @@
+package dirwatch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+func tempDir(t *testing.T) (dir string, cleanup func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dirwatch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestAddEntityToMergesOnDirectInfoHashCollision(t *testing.T) {
+	ee := make(map[torrent.InfoHash]entity)
+	var ih torrent.InfoHash
+	ih[0] = 1
+	v2 := HashV2{1}
+
+	// A v1-only entity (e.g. from foo.magnet) is scanned first, then a
+	// hybrid foo.torrent carrying InfoHashV2 for the same v1-compatible
+	// InfoHash -- the scenario that used to silently drop the later
+	// entity's data.
+	addEntityTo(ee, entity{InfoHash: ih, Trackers: []string{"http://a"}})
+	addEntityTo(ee, entity{InfoHash: ih, InfoHashV2: &v2, Trackers: []string{"http://b"}})
+
+	got, ok := ee[ih]
+	if !ok {
+		t.Fatal("expected an entity for ih")
+	}
+	if got.InfoHashV2 == nil || *got.InfoHashV2 != v2 {
+		t.Fatalf("expected the merged entity to carry InfoHashV2, got %+v", got)
+	}
+	if len(got.Trackers) != 2 {
+		t.Fatalf("expected both trackers to survive the merge, got %v", got.Trackers)
+	}
+}
+
+func TestIsTorrentFile(t *testing.T) {
+	cases := []struct {
+		name string
+		want bool
+	}{
+		{"foo.torrent", true},
+		{"foo.magnet", false},
+		{"foo.torrents", false},
+		{"foo.txt", false},
+	}
+	for _, c := range cases {
+		if got := isTorrentFile(c.name); got != c.want {
+			t.Errorf("isTorrentFile(%q) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestWebSeedsFilePath(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"/d/foo.torrent", "/d/foo.webseeds"},
+		{"/d/foo.magnet", "/d/foo.webseeds"},
+		{"/d/foo.torrents", "/d/foo.webseeds"},
+	}
+	for _, c := range cases {
+		if got := webSeedsFilePath(c.in); got != c.want {
+			t.Errorf("webSeedsFilePath(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestScanFileTorrentsExtensionMatchesMagnetSemantics(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	const uriA = "magnet:?xt=urn:btih:0000000000000000000000000000000000000001"
+	const uriB = "magnet:?xt=urn:btih:0000000000000000000000000000000000000002"
+	path := filepath.Join(dir, "index.torrents")
+	content := "# a comment\n" + uriA + "\n#" + uriB + "\n" + uriB + "\n" + uriB + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	me := &Instance{}
+	ee := me.scanFile(path)
+	if len(ee) != 2 {
+		t.Fatalf("expected 2 entities from the .torrents file, got %d: %+v", len(ee), ee)
+	}
+}
+
+type fakeHandler struct {
+	added   chan Event
+	removed chan Event
+}
+
+func newFakeHandler() *fakeHandler {
+	return &fakeHandler{
+		added:   make(chan Event, 16),
+		removed: make(chan Event, 16),
+	}
+}
+
+func (h *fakeHandler) OnAdded(e Event) error {
+	h.added <- e
+	return nil
+}
+
+func (h *fakeHandler) OnRemoved(e Event) error {
+	h.removed <- e
+	return nil
+}
+
+func waitForEvent(t *testing.T, ch chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a handler call")
+		return Event{}
+	}
+}
+
+func newTestInstance(h Handler) *Instance {
+	me := &Instance{
+		handler:      h,
+		dirState:     make(map[torrent.InfoHash]entity),
+		fileState:    make(map[string]map[torrent.InfoHash]entity),
+		acked:        make(map[torrent.InfoHash]bool),
+		handlerChain: make(map[torrent.InfoHash]chan struct{}),
+		ackReq:       make(chan torrent.InfoHash, 16),
+		closed:       make(chan struct{}),
+	}
+	return me
+}
+
+func TestHandleWriteDiffsAgainstPreviousState(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	const uriA = "magnet:?xt=urn:btih:0000000000000000000000000000000000000001"
+	const uriB = "magnet:?xt=urn:btih:0000000000000000000000000000000000000002"
+	path := filepath.Join(dir, "one.magnet")
+	if err := ioutil.WriteFile(path, []byte(uriA+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newFakeHandler()
+	me := newTestInstance(h)
+
+	// Seed state as if a previous scan had already found uriA, without
+	// going through torrentAdded (which would itself call the handler).
+	fe := me.scanFile(path)
+	me.fileState[path] = fe
+	for ih, e := range fe {
+		me.dirState[ih] = e
+	}
+
+	if err := ioutil.WriteFile(path, []byte(uriB+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	me.handleWrite(path)
+
+	removed := waitForEvent(t, h.removed)
+	if removed.Change != Removed {
+		t.Fatalf("expected a Removed event, got %+v", removed)
+	}
+	added := waitForEvent(t, h.added)
+	if added.Change != Added || added.MagnetURI != uriB {
+		t.Fatalf("expected an Added event for %q, got %+v", uriB, added)
+	}
+}
+
+func TestEnqueueHandlerCallOrdersSameInfoHash(t *testing.T) {
+	me := newTestInstance(nil)
+
+	var ih torrent.InfoHash
+	var mu sync.Mutex
+	var order []int
+	release := make(chan struct{})
+
+	me.enqueueHandlerCall(ih, func() error {
+		<-release
+		mu.Lock()
+		order = append(order, 1)
+		mu.Unlock()
+		return nil
+	}, false)
+	done := make(chan struct{})
+	me.enqueueHandlerCall(ih, func() error {
+		mu.Lock()
+		order = append(order, 2)
+		mu.Unlock()
+		close(done)
+		return nil
+	}, false)
+
+	select {
+	case <-done:
+		t.Fatal("the second call for the same infohash ran before the first finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the chained handler call")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Fatalf("expected calls in order [1 2], got %v", order)
+	}
+}
+
+func TestResolveTorrentURLNegativeCachesFailures(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	cacheDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	me := &Instance{
+		opts: Options{
+			CacheDir:     cacheDir,
+			FetchTimeout: time.Second,
+		},
+		fetching:     make(map[string]bool),
+		fetchFailure: make(map[string]time.Time),
+		closed:       make(chan struct{}),
+	}
+
+	if _, ok := me.resolveTorrentURL(srv.URL); ok {
+		t.Fatal("expected resolveTorrentURL to report unresolved on the first call")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		me.fetchMu.Lock()
+		_, failed := me.fetchFailure[srv.URL]
+		me.fetchMu.Unlock()
+		if failed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the background fetch to record a failure")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, ok := me.resolveTorrentURL(srv.URL); ok {
+		t.Fatal("expected a second call within the cooldown to still report unresolved")
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("expected exactly one request to the server, got %d", got)
+	}
+}
+
+func TestResolveTorrentURLDoesNotBlockCaller(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cacheDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	me := &Instance{
+		opts: Options{
+			CacheDir: cacheDir,
+		},
+		fetching:     make(map[string]bool),
+		fetchFailure: make(map[string]time.Time),
+		rescanReq:    make(chan struct{}, 1),
+		closed:       make(chan struct{}),
+	}
+
+	start := time.Now()
+	if _, ok := me.resolveTorrentURL(srv.URL); ok {
+		t.Fatal("expected resolveTorrentURL to report unresolved while the fetch is in flight")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("resolveTorrentURL blocked for %s waiting on a slow server", elapsed)
+	}
+}